@@ -0,0 +1,31 @@
+package asset
+
+import (
+	"golang.org/x/net/context"
+
+	"chain/api/utxodb"
+	"chain/errors"
+)
+
+// WarmUpKeeper loads the full confirmed and unconfirmed utxo sets for
+// accountID/assetID from the store installed in ctx and adds them to
+// k, so that k has something to reserve against before the first
+// utxo is attached or applied through it directly.
+func WarmUpKeeper(ctx context.Context, k *utxodb.Keeper, accountID, assetID string) error {
+	confirmed, err := LoadUTXOs(ctx, accountID, assetID)
+	if err != nil {
+		return errors.Wrap(err, "loading confirmed utxos")
+	}
+	for _, u := range confirmed {
+		k.Add(u, false)
+	}
+
+	unconfirmed, err := LoadUnconfirmedUTXOs(ctx, accountID, assetID)
+	if err != nil {
+		return errors.Wrap(err, "loading unconfirmed utxos")
+	}
+	for _, u := range unconfirmed {
+		k.Add(u, true)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package asset
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"chain/api/asset/memstore"
+	"chain/api/utxodb"
+	"chain/fedchain/bc"
+)
+
+func TestListUTXOsSpendableOnly(t *testing.T) {
+	store := memstore.New()
+	ctx := NewContext(context.Background(), store)
+
+	assetID := bc.AssetID{1}
+	hash := bc.Hash{1}
+	txouts := []*bc.TxOutput{{AssetID: assetID, Value: 10}}
+	recs := []*utxodb.Receiver{{AccountID: "acc1"}}
+	if _, err := store.Put(ctx, hash, txouts, recs); err != nil {
+		t.Fatal(err)
+	}
+	out := bc.Outpoint{Hash: hash, Index: 0}
+
+	k := utxodb.NewKeeper()
+	k.Add(&utxodb.UTXO{AccountID: "acc1", AssetID: assetID.String(), Amount: 10, Outpoint: out}, false)
+
+	filter := utxodb.Filter{AccountIDs: []string{"acc1"}, SpendableOnly: true}
+	utxos, err := ListUTXOs(ctx, k, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 1 {
+		t.Fatalf("got %d utxos before reservation, want 1", len(utxos))
+	}
+
+	if _, _, err := k.Reserve("acc1", assetID.String(), 10, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	utxos, err = ListUTXOs(ctx, k, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 0 {
+		t.Fatalf("got %d utxos after reservation, want 0 (SpendableOnly should exclude reserved outputs)", len(utxos))
+	}
+
+	// Without SpendableOnly, the reserved output is still listed.
+	filter.SpendableOnly = false
+	utxos, err = ListUTXOs(ctx, k, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 1 {
+		t.Fatalf("got %d utxos with SpendableOnly disabled, want 1", len(utxos))
+	}
+}
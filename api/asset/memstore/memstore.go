@@ -0,0 +1,205 @@
+// Package memstore is an in-memory asset.UTXOStore, for tests that
+// want to exercise utxo-handling code without the weight of a real
+// Postgres fixture.
+package memstore
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"chain/api/appdb"
+	"chain/api/utxodb"
+	"chain/fedchain/bc"
+)
+
+// Store is a concurrency-safe, in-memory implementation of
+// asset.UTXOStore. Create one with New: the zero value has nil maps,
+// and Put or AttachUnconfirmed on it panics.
+type Store struct {
+	mu          sync.Mutex
+	confirmed   map[bc.Outpoint]*utxodb.UTXO
+	unconfirmed map[bc.Outpoint]*utxodb.UTXO
+	activity    []*bc.Tx
+}
+
+// New returns an empty Store.
+func New() *Store {
+	return &Store{
+		confirmed:   make(map[bc.Outpoint]*utxodb.UTXO),
+		unconfirmed: make(map[bc.Outpoint]*utxodb.UTXO),
+	}
+}
+
+func (s *Store) List(ctx context.Context, accountID, assetID string, includeUnconfirmed bool) ([]*utxodb.UTXO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var utxos []*utxodb.UTXO
+	for _, u := range s.confirmed {
+		if u.AccountID == accountID && u.AssetID == assetID {
+			utxos = append(utxos, u)
+		}
+	}
+	if includeUnconfirmed {
+		for _, u := range s.unconfirmed {
+			if u.AccountID == accountID && u.AssetID == assetID {
+				utxos = append(utxos, u)
+			}
+		}
+	}
+	return utxos, nil
+}
+
+// ListUnconfirmed returns only the pool-only outputs for
+// accountID/assetID.
+func (s *Store) ListUnconfirmed(ctx context.Context, accountID, assetID string) ([]*utxodb.UTXO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var utxos []*utxodb.UTXO
+	for _, u := range s.unconfirmed {
+		if u.AccountID == accountID && u.AssetID == assetID {
+			utxos = append(utxos, u)
+		}
+	}
+	return utxos, nil
+}
+
+// ListFiltered supports every Filter field except Scripts and
+// Addresses, since memstore has no addresses table to resolve them
+// against; a filter using those fields matches nothing additional.
+func (s *Store) ListFiltered(ctx context.Context, filter utxodb.Filter) ([]*utxodb.UTXO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inSet := func(vs []string, v string) bool {
+		if len(vs) == 0 {
+			return true
+		}
+		for _, x := range vs {
+			if x == v {
+				return true
+			}
+		}
+		return false
+	}
+	outpointWanted := func(out bc.Outpoint) bool {
+		if len(filter.Outpoints) == 0 {
+			return true
+		}
+		for _, o := range filter.Outpoints {
+			if o == out {
+				return true
+			}
+		}
+		return false
+	}
+
+	var utxos []*utxodb.UTXO
+	for _, u := range s.confirmed {
+		if !inSet(filter.AccountIDs, u.AccountID) || !inSet(filter.AssetIDs, u.AssetID) {
+			continue
+		}
+		if !outpointWanted(u.Outpoint) {
+			continue
+		}
+		if u.Amount < filter.MinAmount {
+			continue
+		}
+		utxos = append(utxos, u)
+	}
+	return utxos, nil
+}
+
+func (s *Store) Get(ctx context.Context, out bc.Outpoint) (*utxodb.UTXO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.confirmed[out]; ok {
+		return u, nil
+	}
+	if u, ok := s.unconfirmed[out]; ok {
+		return u, nil
+	}
+	return nil, nil
+}
+
+func (s *Store) Put(ctx context.Context, hash bc.Hash, txouts []*bc.TxOutput, recs []*utxodb.Receiver) ([]*appdb.UTXO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var inserted []*appdb.UTXO
+	for i, txo := range txouts {
+		out := bc.Outpoint{Hash: hash, Index: uint32(i)}
+		u := &utxodb.UTXO{
+			AssetID:  txo.AssetID.String(),
+			Amount:   uint64(txo.Value),
+			Outpoint: out,
+		}
+		au := &appdb.UTXO{UTXO: u}
+		if rec := recs[i]; rec != nil {
+			u.AccountID = rec.AccountID
+			au.ManagerNodeID = rec.ManagerNodeID
+			au.IsChange = rec.IsChange
+			copy(au.AddrIndex[:], rec.AddrIndex)
+		}
+		s.confirmed[out] = u
+		inserted = append(inserted, au)
+	}
+	return inserted, nil
+}
+
+func (s *Store) Delete(ctx context.Context, txins []*bc.TxInput) ([]*utxodb.UTXO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted []*utxodb.UTXO
+	for _, in := range txins {
+		if u, ok := s.confirmed[in.Previous]; ok {
+			deleted = append(deleted, u)
+			delete(s.confirmed, in.Previous)
+		}
+		delete(s.unconfirmed, in.Previous)
+	}
+	return deleted, nil
+}
+
+func (s *Store) AttachUnconfirmed(ctx context.Context, tx *bc.Tx, recs []*utxodb.Receiver) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash := tx.Hash()
+	for i, txo := range tx.Outputs {
+		out := bc.Outpoint{Hash: hash, Index: uint32(i)}
+		u := &utxodb.UTXO{
+			AssetID:  txo.AssetID.String(),
+			Amount:   uint64(txo.Value),
+			Outpoint: out,
+		}
+		if rec := recs[i]; rec != nil {
+			u.AccountID = rec.AccountID
+		}
+		s.unconfirmed[out] = u
+	}
+	return nil
+}
+
+func (s *Store) DetachUnconfirmed(ctx context.Context, hash bc.Hash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for out := range s.unconfirmed {
+		if out.Hash == hash {
+			delete(s.unconfirmed, out)
+		}
+	}
+	return nil
+}
+
+func (s *Store) LoadAddressInfo(ctx context.Context, utxos []*appdb.UTXO) error {
+	// memstore has no addresses table to consult; callers are
+	// expected to supply receiver info directly via Put.
+	return nil
+}
+
+func (s *Store) WriteActivity(ctx context.Context, tx *bc.Tx, localUTXOs []*appdb.UTXO, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activity = append(s.activity, tx)
+	return nil
+}
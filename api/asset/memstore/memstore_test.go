@@ -0,0 +1,133 @@
+package memstore
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"chain/api/utxodb"
+	"chain/fedchain/bc"
+)
+
+func TestStorePutListDelete(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	hash := bc.Hash{1}
+	txouts := []*bc.TxOutput{{
+		AssetID: bc.AssetID{2},
+		Value:   100,
+	}}
+	recs := []*utxodb.Receiver{{AccountID: "acc1"}}
+
+	inserted, err := s.Put(ctx, hash, txouts, recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inserted) != 1 {
+		t.Fatalf("got %d inserted, want 1", len(inserted))
+	}
+
+	utxos, err := s.List(ctx, "acc1", txouts[0].AssetID.String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 1 {
+		t.Fatalf("got %d utxos, want 1", len(utxos))
+	}
+
+	txins := []*bc.TxInput{{Previous: bc.Outpoint{Hash: hash, Index: 0}}}
+	deleted, err := s.Delete(ctx, txins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 {
+		t.Fatalf("got %d deleted, want 1", len(deleted))
+	}
+
+	utxos, err = s.List(ctx, "acc1", txouts[0].AssetID.String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 0 {
+		t.Fatalf("got %d utxos after delete, want 0", len(utxos))
+	}
+}
+
+func seedFiltered(t *testing.T, s *Store) {
+	t.Helper()
+	ctx := context.Background()
+	seed := []struct {
+		hash      bc.Hash
+		accountID string
+		assetID   bc.AssetID
+		amount    uint64
+	}{
+		{bc.Hash{1}, "acc1", bc.AssetID{1}, 10},
+		{bc.Hash{2}, "acc1", bc.AssetID{1}, 100},
+		{bc.Hash{3}, "acc2", bc.AssetID{1}, 50},
+		{bc.Hash{4}, "acc1", bc.AssetID{2}, 20},
+	}
+	for _, u := range seed {
+		txouts := []*bc.TxOutput{{AssetID: u.assetID, Value: int64(u.amount)}}
+		recs := []*utxodb.Receiver{{AccountID: u.accountID}}
+		if _, err := s.Put(ctx, u.hash, txouts, recs); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStoreListFiltered(t *testing.T) {
+	ctx := context.Background()
+
+	cases := []struct {
+		name   string
+		filter utxodb.Filter
+		want   int
+	}{
+		{"accountID", utxodb.Filter{AccountIDs: []string{"acc1"}}, 3},
+		{"assetID", utxodb.Filter{AssetIDs: []string{bc.AssetID{2}.String()}}, 1},
+		{"minAmount", utxodb.Filter{MinAmount: 50}, 2},
+		{"outpoint", utxodb.Filter{Outpoints: []bc.Outpoint{{Hash: bc.Hash{3}, Index: 0}}}, 1},
+		{"accountAndMinAmount", utxodb.Filter{AccountIDs: []string{"acc1"}, MinAmount: 50}, 1},
+		{"noMatch", utxodb.Filter{AccountIDs: []string{"acc3"}}, 0},
+		{"zeroValue", utxodb.Filter{}, 4},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := New()
+			seedFiltered(t, s)
+			got, err := s.ListFiltered(ctx, c.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != c.want {
+				t.Errorf("got %d utxos, want %d", len(got), c.want)
+			}
+		})
+	}
+}
+
+// TestStoreListFilteredIgnoresAddresses pins a known limitation:
+// unlike pgstore, memstore has no addresses table to resolve Addresses
+// or Scripts against, so a filter using either matches the same rows
+// as if it weren't set at all, rather than narrowing to a specific
+// address the way pgstore's ListFiltered does (see the account-vs-
+// address fix in its address predicate).
+func TestStoreListFilteredIgnoresAddresses(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	seedFiltered(t, s)
+
+	withAddr, err := s.ListFiltered(ctx, utxodb.Filter{Addresses: []string{"unknown-address"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	without, err := s.ListFiltered(ctx, utxodb.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(withAddr) != len(without) {
+		t.Errorf("got %d utxos with an Addresses filter, want %d (Addresses has no effect in memstore)", len(withAddr), len(without))
+	}
+}
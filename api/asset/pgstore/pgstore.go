@@ -0,0 +1,486 @@
+// Package pgstore is the Postgres-backed implementation of
+// asset.UTXOStore. It holds the authoritative utxo set; an in-memory
+// asset.UTXOStore used for tests lives in asset/memstore.
+package pgstore
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"chain/api/appdb"
+	"chain/api/utxodb"
+	"chain/database/pg"
+	"chain/errors"
+	"chain/fedchain-sandbox/txscript"
+	"chain/fedchain/bc"
+	"chain/log"
+	"chain/metrics"
+)
+
+// confirmedTable and unconfirmedTable name the two tables that
+// together make up the spendable utxo set. Rows in utxos come from
+// Put, once a tx has landed in a block. Rows in unconfirmed_utxos come
+// from AttachUnconfirmed, as soon as a tx enters the pool, and let a
+// later tx in the same pool spend them before confirmation
+// (chain-spending).
+const (
+	confirmedTable   = "utxos"
+	unconfirmedTable = "unconfirmed_utxos"
+)
+
+// Store is a Postgres-backed asset.UTXOStore. The zero value is ready
+// to use; it carries no state of its own, reading and writing through
+// whatever *sql.DB or *sql.Tx is in ctx (see chain/database/pg).
+type Store struct{}
+
+// New returns a Store.
+func New() Store { return Store{} }
+
+// List returns every utxo for accountID/assetID. If includeUnconfirmed
+// is true, the result also includes outputs of transactions that are
+// in the pool but not yet confirmed in a block.
+func (Store) List(ctx context.Context, accountID, assetID string, includeUnconfirmed bool) ([]*utxodb.UTXO, error) {
+	confirmed, err := list(ctx, accountID, assetID, confirmedTable)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading confirmed utxos")
+	}
+	if !includeUnconfirmed {
+		return confirmed, nil
+	}
+	unconfirmed, err := list(ctx, accountID, assetID, unconfirmedTable)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading unconfirmed utxos")
+	}
+	return append(confirmed, unconfirmed...), nil
+}
+
+// ListUnconfirmed returns only the pool-only outputs for
+// accountID/assetID, reading unconfirmedTable directly rather than
+// going through List and discarding its confirmed half.
+func (Store) ListUnconfirmed(ctx context.Context, accountID, assetID string) ([]*utxodb.UTXO, error) {
+	unconfirmed, err := list(ctx, accountID, assetID, unconfirmedTable)
+	return unconfirmed, errors.Wrap(err, "loading unconfirmed utxos")
+}
+
+func list(ctx context.Context, accountID, assetID, table string) ([]*utxodb.UTXO, error) {
+	log.Messagef(ctx, "loading full utxo set from %s", table)
+	t0 := time.Now()
+	q := `
+		SELECT amount, txid, index
+		FROM ` + table + `
+		WHERE account_id=$1 AND asset_id=$2
+	`
+	rows, err := pg.FromContext(ctx).Query(q, accountID, assetID)
+	if err != nil {
+		return nil, errors.Wrap(err, "query")
+	}
+	defer rows.Close()
+	var utxos []*utxodb.UTXO
+	for rows.Next() {
+		u := &utxodb.UTXO{
+			AccountID: accountID,
+			AssetID:   assetID,
+		}
+		var txid string
+		err = rows.Scan(
+			&u.Amount,
+			&txid,
+			&u.Outpoint.Index,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan")
+		}
+		h, err := bc.ParseHash(txid)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode hash")
+		}
+		u.Outpoint.Hash = h
+		utxos = append(utxos, u)
+		if len(utxos)%1e6 == 0 {
+			log.Messagef(ctx, "loaded %d utxos so far", len(utxos))
+		}
+	}
+	log.Messagef(ctx, "loaded %d utxos done (%v)", len(utxos), time.Since(t0))
+	return utxos, errors.Wrap(rows.Err(), "rows")
+}
+
+// ListFiltered returns every confirmed utxo matching filter. Each
+// non-empty field of filter other than SpendableOnly becomes a
+// pushed-down predicate rather than a post-filter in Go, so Postgres
+// only ever returns rows that already match; the result is still read
+// fully into memory, like List. SpendableOnly is ignored here;
+// asset.ListUTXOs applies it.
+//
+// Script-based matching goes through the addresses table: a script
+// is first turned into its address via txscript.PkScriptAddr (same as
+// insertUTXOs does for new outputs), then matched the same way an
+// explicit address filter would be.
+func (Store) ListFiltered(ctx context.Context, filter utxodb.Filter) ([]*utxodb.UTXO, error) {
+	addrs := append([]string{}, filter.Addresses...)
+	for _, script := range filter.Scripts {
+		addr, err := txscript.PkScriptAddr(script)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode script")
+		}
+		addrs = append(addrs, addr.String())
+	}
+
+	where := []string{"true"}
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if len(filter.AccountIDs) > 0 {
+		where = append(where, "account_id = ANY("+arg(pg.Strings(filter.AccountIDs))+")")
+	}
+	if len(filter.AssetIDs) > 0 {
+		where = append(where, "asset_id = ANY("+arg(pg.Strings(filter.AssetIDs))+")")
+	}
+	if len(addrs) > 0 {
+		// Narrow to the specific address, not every utxo under the
+		// account that happens to own it: addresses.key_index is the
+		// same encoding as utxos.addr_index (see toKeyIndex), so a
+		// utxo belongs to an address iff both its account_id and
+		// addr_index match that address's row.
+		where = append(where, `(account_id, addr_index) IN (
+			SELECT account_id, key_index FROM addresses WHERE address = ANY(`+arg(pg.Strings(addrs))+`)
+		)`)
+	}
+	if len(filter.Outpoints) > 0 {
+		var txids []string
+		var indexes []uint32
+		for _, out := range filter.Outpoints {
+			txids = append(txids, out.Hash.String())
+			indexes = append(indexes, out.Index)
+		}
+		where = append(where, "(txid, index) IN (SELECT unnest("+arg(pg.Strings(txids))+"::text[]), unnest("+arg(pg.Uint32s(indexes))+"::bigint[]))")
+	}
+	if filter.MinAmount > 0 {
+		where = append(where, "amount >= "+arg(int64(filter.MinAmount)))
+	}
+
+	q := `
+		SELECT account_id, asset_id, amount, txid, index
+		FROM ` + confirmedTable + `
+		WHERE ` + strings.Join(where, " AND ")
+
+	rows, err := pg.FromContext(ctx).Query(q, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "query")
+	}
+	defer rows.Close()
+	var utxos []*utxodb.UTXO
+	for rows.Next() {
+		u := new(utxodb.UTXO)
+		var txid string
+		err = rows.Scan(&u.AccountID, &u.AssetID, &u.Amount, &txid, &u.Outpoint.Index)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan")
+		}
+		h, err := bc.ParseHash(txid)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode hash")
+		}
+		u.Outpoint.Hash = h
+		utxos = append(utxos, u)
+	}
+	return utxos, errors.Wrap(rows.Err(), "rows")
+}
+
+// Get looks up a single output by its outpoint, checking the confirmed
+// table first and falling back to the unconfirmed one. It reports
+// (nil, nil) if out isn't in either.
+func (Store) Get(ctx context.Context, out bc.Outpoint) (*utxodb.UTXO, error) {
+	for _, table := range []string{confirmedTable, unconfirmedTable} {
+		u, err := get(ctx, out, table)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get from %s", table)
+		}
+		if u != nil {
+			return u, nil
+		}
+	}
+	return nil, nil
+}
+
+func get(ctx context.Context, out bc.Outpoint, table string) (*utxodb.UTXO, error) {
+	q := `
+		SELECT account_id, asset_id, amount
+		FROM ` + table + `
+		WHERE txid=$1 AND index=$2
+	`
+	rows, err := pg.FromContext(ctx).Query(q, out.Hash.String(), out.Index)
+	if err != nil {
+		return nil, errors.Wrap(err, "query")
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, errors.Wrap(rows.Err(), "rows")
+	}
+	u := &utxodb.UTXO{Outpoint: out}
+	err = rows.Scan(&u.AccountID, &u.AssetID, &u.Amount)
+	if err != nil {
+		return nil, errors.Wrap(err, "scan")
+	}
+	return u, nil
+}
+
+// Put inserts the outputs of a transaction with the given hash into
+// the confirmed utxo set, associating each with its receiver info.
+// Must be called inside a transaction.
+func (Store) Put(ctx context.Context, hash bc.Hash, txouts []*bc.TxOutput, recs []*utxodb.Receiver) ([]*appdb.UTXO, error) {
+	_ = pg.FromContext(ctx).(pg.Tx) // panics if not in a db transaction
+	return insertUTXOs(ctx, confirmedTable, hash, txouts, recs)
+}
+
+// Delete removes the confirmed and unconfirmed utxos spent by txins,
+// i.e. the outputs they reference, and returns the confirmed ones that
+// were removed. An input may spend an output that only exists in the
+// unconfirmed table (chain-spending), so both are checked.
+func (Store) Delete(ctx context.Context, txins []*bc.TxInput) ([]*utxodb.UTXO, error) {
+	deleted, err := deleteUTXOs(ctx, confirmedTable, txins)
+	if err != nil {
+		return nil, errors.Wrap(err, "delete confirmed")
+	}
+	_, err = deleteUTXOs(ctx, unconfirmedTable, txins)
+	if err != nil {
+		return nil, errors.Wrap(err, "delete unconfirmed")
+	}
+	return deleted, nil
+}
+
+// AttachUnconfirmed records the outputs of tx in the unconfirmed utxo
+// set as soon as tx enters the pool, so that later, still-unconfirmed
+// transactions in the same pool can spend them.
+func (Store) AttachUnconfirmed(ctx context.Context, tx *bc.Tx, recs []*utxodb.Receiver) error {
+	defer metrics.RecordElapsed(time.Now())
+	_, err := insertUTXOs(ctx, unconfirmedTable, tx.Hash(), tx.Outputs, recs)
+	return errors.Wrap(err, "insert unconfirmed")
+}
+
+// DetachUnconfirmed removes the unconfirmed outputs created by the
+// transaction with the given hash, whether because it was dropped
+// from the pool or because it was just confirmed and Put moved its
+// outputs into the confirmed table.
+func (Store) DetachUnconfirmed(ctx context.Context, hash bc.Hash) error {
+	defer metrics.RecordElapsed(time.Now())
+	const q = `DELETE FROM unconfirmed_utxos WHERE txid=$1`
+	_, err := pg.FromContext(ctx).Exec(q, hash.String())
+	return errors.Wrap(err, "delete unconfirmed")
+}
+
+// WriteActivity records an activity item for tx. It's a thin wrapper
+// so that asset.ApplyTx doesn't need to import appdb directly.
+func (Store) WriteActivity(ctx context.Context, tx *bc.Tx, localUTXOs []*appdb.UTXO, at time.Time) error {
+	return appdb.WriteActivity(ctx, tx, localUTXOs, at)
+}
+
+// utxoSet holds a set of utxo record values
+// to be inserted into the db.
+type utxoSet struct {
+	txid          string
+	index         pg.Uint32s
+	assetID       pg.Strings
+	amount        pg.Int64s
+	addr          pg.Strings
+	accountID     pg.Strings
+	managerNodeID pg.Strings
+	aIndex        pg.Int64s
+}
+
+func deleteUTXOs(ctx context.Context, table string, txins []*bc.TxInput) ([]*utxodb.UTXO, error) {
+	defer metrics.RecordElapsed(time.Now())
+	var (
+		txid  []string
+		index []uint32
+	)
+	for _, in := range txins {
+		txid = append(txid, in.Previous.Hash.String())
+		index = append(index, in.Previous.Index)
+	}
+
+	q := `
+		WITH outpoints AS (
+			SELECT unnest($1::text[]), unnest($2::bigint[])
+		)
+		DELETE FROM ` + table + `
+		WHERE (txid, index) IN (TABLE outpoints)
+		RETURNING account_id, asset_id, txid, index
+	`
+	rows, err := pg.FromContext(ctx).Query(q, pg.Strings(txid), pg.Uint32s(index))
+	if err != nil {
+		return nil, errors.Wrap(err, "delete")
+	}
+	defer rows.Close()
+	var deleted []*utxodb.UTXO
+	for rows.Next() {
+		u := new(utxodb.UTXO)
+		var txid string
+		err = rows.Scan(&u.AccountID, &u.AssetID, &txid, &u.Outpoint.Index)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan")
+		}
+		h, err := bc.ParseHash(txid)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode hash")
+		}
+		u.Outpoint.Hash = h
+		deleted = append(deleted, u)
+	}
+	return deleted, rows.Err()
+}
+
+func insertUTXOs(ctx context.Context, table string, hash bc.Hash, txouts []*bc.TxOutput, recs []*utxodb.Receiver) ([]*appdb.UTXO, error) {
+	if len(txouts) != len(recs) {
+		return nil, errors.New("length mismatch")
+	}
+	defer metrics.RecordElapsed(time.Now())
+
+	// This function inserts utxos into the db, and maps
+	// them to receiver info (account id and addr index).
+	// There are three cases:
+	// 1. UTXO pays change or to an "immediate" account receiver.
+	//    In this case, we get the receiver info from recs
+	//    (which came from the client and was validated
+	//    in FinalizeTx).
+	// 2. UTXO pays to an address receiver record.
+	//    In this case, we get the receiver info from
+	//    the addresses table (and eventually delete
+	//    the record).
+	// 3. UTXO pays to an unknown address.
+	//    In this case, there is no receiver info.
+	insert, err := initAddrInfoFromRecs(hash, txouts, recs) // case 1
+	if err != nil {
+		return nil, err
+	}
+	err = loadAddrInfoFromDB(ctx, insert) // case 2
+	if err != nil {
+		return nil, err
+	}
+
+	outs := &utxoSet{txid: hash.String()}
+	for i, u := range insert {
+		outs.index = append(outs.index, uint32(i))
+		outs.assetID = append(outs.assetID, u.AssetID)
+		outs.amount = append(outs.amount, int64(u.Amount))
+		outs.accountID = append(outs.accountID, u.AccountID)
+		outs.managerNodeID = append(outs.managerNodeID, u.ManagerNodeID)
+		outs.aIndex = append(outs.aIndex, toKeyIndex(u.AddrIndex[:]))
+	}
+
+	q := `
+		INSERT INTO ` + table + ` (
+			txid, index, asset_id, amount,
+			account_id, manager_node_id, addr_index
+		)
+		SELECT
+			$1::text,
+			unnest($2::bigint[]),
+			unnest($3::text[]),
+			unnest($4::bigint[]),
+			unnest($5::text[]),
+			unnest($6::text[]),
+			unnest($7::bigint[])
+	`
+	_, err = pg.FromContext(ctx).Exec(q,
+		hash.String(),
+		outs.index,
+		outs.assetID,
+		outs.amount,
+		outs.accountID,
+		outs.managerNodeID,
+		outs.aIndex,
+	)
+	return insert, errors.Wrap(err)
+}
+
+func initAddrInfoFromRecs(hash bc.Hash, txouts []*bc.TxOutput, recs []*utxodb.Receiver) ([]*appdb.UTXO, error) {
+	insert := make([]*appdb.UTXO, len(txouts))
+	for i, txo := range txouts {
+		addr, err := txscript.PkScriptAddr(txo.Script)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad pk script")
+		}
+		u := &appdb.UTXO{
+			Addr: addr.String(),
+			UTXO: &utxodb.UTXO{
+				AssetID:  txo.AssetID.String(),
+				Amount:   uint64(txo.Value),
+				Outpoint: bc.Outpoint{Hash: hash, Index: uint32(i)},
+			},
+		}
+		if rec := recs[i]; rec != nil {
+			u.ManagerNodeID = rec.ManagerNodeID
+			u.AccountID = rec.AccountID
+			copy(u.AddrIndex[:], rec.AddrIndex)
+			u.IsChange = rec.IsChange
+		}
+		insert[i] = u
+	}
+	return insert, nil
+}
+
+// LoadAddressInfo loads account ID and addr index from the addresses
+// table for utxos that need it. Not all are guaranteed to be in the
+// database; some outputs will be owned by third parties. This
+// function loads what it can.
+func (Store) LoadAddressInfo(ctx context.Context, utxos []*appdb.UTXO) error {
+	return loadAddrInfoFromDB(ctx, utxos)
+}
+
+func loadAddrInfoFromDB(ctx context.Context, utxos []*appdb.UTXO) error {
+	var addrs []string
+	for _, u := range utxos {
+		if u.AccountID == "" {
+			addrs = append(addrs, u.Addr)
+		}
+	}
+
+	const q = `
+		SELECT address, account_id, manager_node_id, key_index(key_index), is_change
+		FROM addresses
+		WHERE address IN (SELECT unnest($1::text[]))
+	`
+	rows, err := pg.FromContext(ctx).Query(q, pg.Strings(addrs))
+	if err != nil {
+		return errors.Wrap(err, "select")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			addr          string
+			managerNodeID string
+			accountID     string
+			addrIndex     []uint32
+			isChange      bool
+		)
+		err = rows.Scan(
+			&addr,
+			&accountID,
+			&managerNodeID,
+			(*pg.Uint32s)(&addrIndex),
+			&isChange,
+		)
+		if err != nil {
+			return errors.Wrap(err, "scan")
+		}
+		for _, u := range utxos {
+			if u.AccountID == "" && u.Addr == addr {
+				u.ManagerNodeID = managerNodeID
+				u.AccountID = accountID
+				u.IsChange = isChange
+				copy(u.AddrIndex[:], addrIndex)
+			}
+		}
+	}
+	return errors.Wrap(rows.Err(), "rows")
+}
+
+func toKeyIndex(i []uint32) int64 {
+	return int64(i[0])<<31 | int64(i[1]&0x7fffffff)
+}
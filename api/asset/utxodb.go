@@ -7,87 +7,152 @@ import (
 
 	"chain/api/appdb"
 	"chain/api/utxodb"
-	"chain/database/pg"
 	"chain/errors"
-	"chain/fedchain-sandbox/txscript"
 	"chain/fedchain/bc"
-	"chain/log"
 	"chain/metrics"
 )
 
-type sqlUTXODB struct{}
+// UTXOStore abstracts the storage of the authoritative utxo set away
+// from any particular backend. The original implementation talked to
+// Postgres directly from this package; it now lives in asset/pgstore,
+// and asset/memstore provides an in-memory implementation for tests
+// that don't want to pay for Postgres fixtures. This also leaves room
+// for a backend whose utxo set lives outside the main SQL cluster.
+type UTXOStore interface {
+	// List returns every utxo for accountID/assetID. If
+	// includeUnconfirmed is true, the result also includes outputs of
+	// transactions that are in the pool but not yet confirmed in a
+	// block (see AttachUnconfirmed).
+	List(ctx context.Context, accountID, assetID string, includeUnconfirmed bool) ([]*utxodb.UTXO, error)
+
+	// ListUnconfirmed returns only the pool-only outputs for
+	// accountID/assetID — the ones List(..., true) would add on top of
+	// the confirmed set — without re-scanning the confirmed table.
+	ListUnconfirmed(ctx context.Context, accountID, assetID string) ([]*utxodb.UTXO, error)
+
+	// ListFiltered is a more general form of List: it returns every
+	// confirmed utxo matching filter. pgstore pushes filter's
+	// predicates into the query; memstore filters in Go.
+	ListFiltered(ctx context.Context, filter utxodb.Filter) ([]*utxodb.UTXO, error)
+
+	// Get looks up a single output by its outpoint. It reports
+	// (nil, nil) if the outpoint isn't in the store.
+	Get(ctx context.Context, out bc.Outpoint) (*utxodb.UTXO, error)
+
+	// Put inserts the outputs of a transaction with the given hash
+	// into the confirmed utxo set. Must be called inside a
+	// transaction.
+	Put(ctx context.Context, hash bc.Hash, txouts []*bc.TxOutput, recs []*utxodb.Receiver) ([]*appdb.UTXO, error)
+
+	// Delete removes the utxos spent by txins and returns the
+	// confirmed ones that were removed.
+	Delete(ctx context.Context, txins []*bc.TxInput) ([]*utxodb.UTXO, error)
+
+	// AttachUnconfirmed and DetachUnconfirmed manage the pool-only
+	// utxo set that backs chain-spending.
+	AttachUnconfirmed(ctx context.Context, tx *bc.Tx, recs []*utxodb.Receiver) error
+	DetachUnconfirmed(ctx context.Context, hash bc.Hash) error
+
+	// LoadAddressInfo fills in account ID, manager node ID, and addr
+	// index for any of utxos that don't already have it.
+	LoadAddressInfo(ctx context.Context, utxos []*appdb.UTXO) error
+
+	// WriteActivity records an activity item for tx.
+	WriteActivity(ctx context.Context, tx *bc.Tx, localUTXOs []*appdb.UTXO, at time.Time) error
+}
+
+type storeKeyType struct{}
+
+var storeKey storeKeyType
+
+// NewContext returns a context that carries store, for use by
+// ApplyTx, LoadUTXOs, and the other package-level functions below.
+// Production callers install a pgstore.Store at request setup; tests
+// can install a memstore.Store instead to avoid touching Postgres.
+func NewContext(ctx context.Context, store UTXOStore) context.Context {
+	return context.WithValue(ctx, storeKey, store)
+}
+
+func storeFromContext(ctx context.Context) UTXOStore {
+	store, ok := ctx.Value(storeKey).(UTXOStore)
+	if !ok {
+		panic("no UTXOStore in context")
+	}
+	return store
+}
+
+// LoadUTXOs returns the confirmed utxo set for accountID/assetID.
+func LoadUTXOs(ctx context.Context, accountID, assetID string) ([]*utxodb.UTXO, error) {
+	return storeFromContext(ctx).List(ctx, accountID, assetID, false)
+}
+
+// LoadAllUTXOs is like LoadUTXOs, but it also includes outputs of
+// transactions that are in the pool but not yet confirmed in a block.
+// Spending one of these requires no more than that the creating tx
+// still be in the pool; see AttachUnconfirmed and DetachUnconfirmed.
+func LoadAllUTXOs(ctx context.Context, accountID, assetID string) ([]*utxodb.UTXO, error) {
+	return storeFromContext(ctx).List(ctx, accountID, assetID, true)
+}
+
+// LoadUnconfirmedUTXOs returns only the pool-only utxo set for
+// accountID/assetID, without the confirmed set LoadAllUTXOs also
+// includes.
+func LoadUnconfirmedUTXOs(ctx context.Context, accountID, assetID string) ([]*utxodb.UTXO, error) {
+	return storeFromContext(ctx).ListUnconfirmed(ctx, accountID, assetID)
+}
 
-func (sqlUTXODB) LoadUTXOs(ctx context.Context, accountID, assetID string) ([]*utxodb.UTXO, error) {
-	log.Messagef(ctx, "loading full utxo set")
-	t0 := time.Now()
-	const q = `
-		SELECT amount, reserved_until, txid, index
-		FROM utxos
-		WHERE account_id=$1 AND asset_id=$2
-	`
-	rows, err := pg.FromContext(ctx).Query(q, accountID, assetID)
+// ListUTXOs returns every utxo matching filter. If filter.SpendableOnly
+// is set and k is non-nil, outputs currently reserved in k are
+// excluded; pass a nil k to skip that check (e.g. when the caller
+// doesn't have a keeper handy and just wants the raw matches).
+func ListUTXOs(ctx context.Context, k *utxodb.Keeper, filter utxodb.Filter) ([]*utxodb.UTXO, error) {
+	utxos, err := storeFromContext(ctx).ListFiltered(ctx, filter)
 	if err != nil {
-		return nil, errors.Wrap(err, "query")
+		return nil, errors.Wrap(err, "list filtered utxos")
 	}
-	defer rows.Close()
-	var utxos []*utxodb.UTXO
-	for rows.Next() {
-		u := &utxodb.UTXO{
-			AccountID: accountID,
-			AssetID:   assetID,
-		}
-		var txid string
-		err = rows.Scan(
-			&u.Amount,
-			&u.ResvExpires,
-			&txid,
-			&u.Outpoint.Index,
-		)
-		if err != nil {
-			return nil, errors.Wrap(err, "scan")
-		}
-		h, err := bc.ParseHash(txid)
-		if err != nil {
-			return nil, errors.Wrap(err, "decode hash")
-		}
-		u.Outpoint.Hash = h
-		u.ResvExpires = u.ResvExpires.UTC()
-		utxos = append(utxos, u)
-		if len(utxos)%1e6 == 0 {
-			log.Messagef(ctx, "loaded %d utxos so far", len(utxos))
+	if !filter.SpendableOnly || k == nil {
+		return utxos, nil
+	}
+	spendable := utxos[:0]
+	for _, u := range utxos {
+		if !k.IsReserved(u.AccountID, u.AssetID, u.Outpoint) {
+			spendable = append(spendable, u)
 		}
 	}
-	log.Messagef(ctx, "loaded %d utxos done (%v)", len(utxos), time.Since(t0))
-	return utxos, errors.Wrap(rows.Err(), "rows")
+	return spendable, nil
 }
 
-func (sqlUTXODB) SaveReservations(ctx context.Context, utxos []*utxodb.UTXO, exp time.Time) error {
-	defer metrics.RecordElapsed(time.Now())
-	const q = `
-		UPDATE utxos
-		SET reserved_until=$3
-		WHERE (txid, index) IN (SELECT unnest($1::text[]), unnest($2::integer[]))
-	`
-	var txids []string
-	var indexes []uint32
-	for _, u := range utxos {
-		txids = append(txids, u.Outpoint.Hash.String())
-		indexes = append(indexes, u.Outpoint.Index)
-	}
-	_, err := pg.FromContext(ctx).Exec(q, pg.Strings(txids), pg.Uint32s(indexes), exp)
-	return errors.Wrap(err, "update utxo reserve expiration")
+// AttachUnconfirmed records the outputs of tx in the unconfirmed utxo
+// set as soon as tx enters the pool, so that later, still-unconfirmed
+// transactions in the same pool can spend them.
+func AttachUnconfirmed(ctx context.Context, tx *bc.Tx, recs []*utxodb.Receiver) error {
+	return storeFromContext(ctx).AttachUnconfirmed(ctx, tx, recs)
+}
+
+// DetachUnconfirmed removes the unconfirmed outputs created by the
+// transaction with the given hash, whether because it was dropped
+// from the pool or because ApplyTx just confirmed it.
+func DetachUnconfirmed(ctx context.Context, hash bc.Hash) error {
+	return storeFromContext(ctx).DetachUnconfirmed(ctx, hash)
 }
 
 // ApplyTx updates the output set to reflect
 // the effects of tx. It deletes consumed utxos
 // and inserts newly-created outputs.
 // Must be called inside a transaction.
-func (sqlUTXODB) ApplyTx(ctx context.Context, tx *bc.Tx, outRecs []*utxodb.Receiver) (deleted, inserted []*utxodb.UTXO, err error) {
+//
+// tx's inputs are not required to come from the confirmed utxo set:
+// an input may spend an output that only exists in the unconfirmed
+// set, i.e. one created by another transaction still in the pool
+// (chain-spending). ApplyTx removes tx's own outputs from the
+// unconfirmed set, since they are now confirmed.
+func ApplyTx(ctx context.Context, tx *bc.Tx, outRecs []*utxodb.Receiver) (deleted, inserted []*utxodb.UTXO, err error) {
 	defer metrics.RecordElapsed(time.Now())
+	store := storeFromContext(ctx)
 	now := time.Now()
 	hash := tx.Hash()
-	_ = pg.FromContext(ctx).(pg.Tx) // panics if not in a db transaction
-	insUTXOs, err := insertUTXOs(ctx, hash, tx.Outputs, outRecs)
+
+	insUTXOs, err := store.Put(ctx, hash, tx.Outputs, outRecs)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "insert")
 	}
@@ -100,219 +165,23 @@ func (sqlUTXODB) ApplyTx(ctx context.Context, tx *bc.Tx, outRecs []*utxodb.Recei
 
 	// Activity items rely on the utxo set, so they should be created after
 	// the output utxos are created but before the input utxos are removed.
-	err = appdb.WriteActivity(ctx, tx, localUTXOs, now)
+	err = store.WriteActivity(ctx, tx, localUTXOs, now)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "creating activity items")
 	}
 
-	deleted, err = deleteUTXOs(ctx, tx.Inputs)
+	deleted, err = store.Delete(ctx, tx.Inputs)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "delete")
 	}
-	for _, u := range localUTXOs {
-		inserted = append(inserted, u.UTXO)
-	}
-	return deleted, inserted, err
-}
-
-// utxoSet holds a set of utxo record values
-// to be inserted into the db.
-type utxoSet struct {
-	txid          string
-	index         pg.Uint32s
-	assetID       pg.Strings
-	amount        pg.Int64s
-	addr          pg.Strings
-	accountID     pg.Strings
-	managerNodeID pg.Strings
-	aIndex        pg.Int64s
-}
-
-func deleteUTXOs(ctx context.Context, txins []*bc.TxInput) ([]*utxodb.UTXO, error) {
-	defer metrics.RecordElapsed(time.Now())
-	var (
-		txid  []string
-		index []uint32
-	)
-	for _, in := range txins {
-		txid = append(txid, in.Previous.Hash.String())
-		index = append(index, in.Previous.Index)
-	}
 
-	const q = `
-		WITH outpoints AS (
-			SELECT unnest($1::text[]), unnest($2::bigint[])
-		)
-		DELETE FROM utxos
-		WHERE (txid, index) IN (TABLE outpoints)
-		RETURNING account_id, asset_id, txid, index
-	`
-	rows, err := pg.FromContext(ctx).Query(q, pg.Strings(txid), pg.Uint32s(index))
+	err = store.DetachUnconfirmed(ctx, hash)
 	if err != nil {
-		return nil, errors.Wrap(err, "delete")
-	}
-	defer rows.Close()
-	var deleted []*utxodb.UTXO
-	for rows.Next() {
-		u := new(utxodb.UTXO)
-		var txid string
-		err = rows.Scan(&u.AccountID, &u.AssetID, &txid, &u.Outpoint.Index)
-		if err != nil {
-			return nil, errors.Wrap(err, "scan")
-		}
-		h, err := bc.ParseHash(txid)
-		if err != nil {
-			return nil, errors.Wrap(err, "decode hash")
-		}
-		u.Outpoint.Hash = h
-		deleted = append(deleted, u)
-	}
-	return deleted, rows.Err()
-}
-
-func insertUTXOs(ctx context.Context, hash bc.Hash, txouts []*bc.TxOutput, recs []*utxodb.Receiver) ([]*appdb.UTXO, error) {
-	if len(txouts) != len(recs) {
-		return nil, errors.New("length mismatch")
-	}
-	defer metrics.RecordElapsed(time.Now())
-
-	// This function inserts utxos into the db, and maps
-	// them to receiver info (account id and addr index).
-	// There are three cases:
-	// 1. UTXO pays change or to an "immediate" account receiver.
-	//    In this case, we get the receiver info from recs
-	//    (which came from the client and was validated
-	//    in FinalizeTx).
-	// 2. UTXO pays to an address receiver record.
-	//    In this case, we get the receiver info from
-	//    the addresses table (and eventually delete
-	//    the record).
-	// 3. UTXO pays to an unknown address.
-	//    In this case, there is no receiver info.
-	insert, err := initAddrInfoFromRecs(hash, txouts, recs) // case 1
-	if err != nil {
-		return nil, err
-	}
-	err = loadAddrInfoFromDB(ctx, insert) // case 2
-	if err != nil {
-		return nil, err
-	}
-
-	outs := &utxoSet{txid: hash.String()}
-	for i, u := range insert {
-		outs.index = append(outs.index, uint32(i))
-		outs.assetID = append(outs.assetID, u.AssetID)
-		outs.amount = append(outs.amount, int64(u.Amount))
-		outs.accountID = append(outs.accountID, u.AccountID)
-		outs.managerNodeID = append(outs.managerNodeID, u.ManagerNodeID)
-		outs.aIndex = append(outs.aIndex, toKeyIndex(u.AddrIndex[:]))
+		return nil, nil, errors.Wrap(err, "detach unconfirmed outputs")
 	}
 
-	const q = `
-		INSERT INTO utxos (
-			txid, index, asset_id, amount,
-			account_id, manager_node_id, addr_index
-		)
-		SELECT
-			$1::text,
-			unnest($2::bigint[]),
-			unnest($3::text[]),
-			unnest($4::bigint[]),
-			unnest($5::text[]),
-			unnest($6::text[]),
-			unnest($7::bigint[])
-	`
-	_, err = pg.FromContext(ctx).Exec(q,
-		hash.String(),
-		outs.index,
-		outs.assetID,
-		outs.amount,
-		outs.accountID,
-		outs.managerNodeID,
-		outs.aIndex,
-	)
-	return insert, errors.Wrap(err)
-}
-
-func initAddrInfoFromRecs(hash bc.Hash, txouts []*bc.TxOutput, recs []*utxodb.Receiver) ([]*appdb.UTXO, error) {
-	insert := make([]*appdb.UTXO, len(txouts))
-	for i, txo := range txouts {
-		addr, err := txscript.PkScriptAddr(txo.Script)
-		if err != nil {
-			return nil, errors.Wrap(err, "bad pk script")
-		}
-		u := &appdb.UTXO{
-			Addr: addr.String(),
-			UTXO: &utxodb.UTXO{
-				AssetID:  txo.AssetID.String(),
-				Amount:   uint64(txo.Value),
-				Outpoint: bc.Outpoint{Hash: hash, Index: uint32(i)},
-			},
-		}
-		if rec := recs[i]; rec != nil {
-			u.ManagerNodeID = rec.ManagerNodeID
-			u.AccountID = rec.AccountID
-			copy(u.AddrIndex[:], rec.AddrIndex)
-			u.IsChange = rec.IsChange
-		}
-		insert[i] = u
-	}
-	return insert, nil
-}
-
-// loadAddrInfoFromDB loads account ID and addr index
-// from the addresses table for utxos that need it.
-// Not all are guaranteed to be in the database;
-// some outputs will be owned by third parties.
-// This function loads what it can.
-func loadAddrInfoFromDB(ctx context.Context, utxos []*appdb.UTXO) error {
-	var addrs []string
-	for _, u := range utxos {
-		if u.AccountID == "" {
-			addrs = append(addrs, u.Addr)
-		}
-	}
-
-	const q = `
-		SELECT address, account_id, manager_node_id, key_index(key_index), is_change
-		FROM addresses
-		WHERE address IN (SELECT unnest($1::text[]))
-	`
-	rows, err := pg.FromContext(ctx).Query(q, pg.Strings(addrs))
-	if err != nil {
-		return errors.Wrap(err, "select")
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var (
-			addr          string
-			managerNodeID string
-			accountID     string
-			addrIndex     []uint32
-			isChange      bool
-		)
-		err = rows.Scan(
-			&addr,
-			&accountID,
-			&managerNodeID,
-			(*pg.Uint32s)(&addrIndex),
-			&isChange,
-		)
-		if err != nil {
-			return errors.Wrap(err, "scan")
-		}
-		for _, u := range utxos {
-			if u.AccountID == "" && u.Addr == addr {
-				u.ManagerNodeID = managerNodeID
-				u.AccountID = accountID
-				u.IsChange = isChange
-				copy(u.AddrIndex[:], addrIndex)
-			}
-		}
+	for _, u := range localUTXOs {
+		inserted = append(inserted, u.UTXO)
 	}
-	return errors.Wrap(rows.Err(), "rows")
-}
-
-func toKeyIndex(i []uint32) int64 {
-	return int64(i[0])<<31 | int64(i[1]&0x7fffffff)
+	return deleted, inserted, err
 }
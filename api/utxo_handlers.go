@@ -0,0 +1,45 @@
+package api
+
+import (
+	"golang.org/x/net/context"
+
+	"chain/api/asset"
+	"chain/api/utxodb"
+)
+
+// listUTXOsReq is the body of a listUTXOs request. Every field is
+// optional; an empty request matches nothing, since account IDs and
+// asset IDs aren't bounded by any project/user scoping at this layer.
+type listUTXOsReq struct {
+	AccountIDs []string `json:"account_ids"`
+	AssetIDs   []string `json:"asset_ids"`
+	Scripts    [][]byte `json:"scripts"`
+	Addresses  []string `json:"addresses"`
+	MinAmount  uint64   `json:"min_amount"`
+}
+
+// listUTXOs serves the utxo-listing endpoint: "what utxos does
+// account X hold" or, just as often for light-client/SPV-style
+// integrators, "what utxos does address X control" — a query they can
+// make knowing only scripts or addresses, not account IDs, and
+// without reserving anything. Route registration (e.g.
+// `m.Handle("/v3/utxos", listUTXOs)`) lives in the main API router,
+// outside this chunk of the tree.
+func listUTXOs(ctx context.Context, req listUTXOsReq) (interface{}, error) {
+	if len(req.AccountIDs) == 0 && len(req.AssetIDs) == 0 && len(req.Scripts) == 0 &&
+		len(req.Addresses) == 0 && req.MinAmount == 0 {
+		return map[string]interface{}{"utxos": []*utxodb.UTXO{}}, nil
+	}
+	filter := utxodb.Filter{
+		AccountIDs: req.AccountIDs,
+		AssetIDs:   req.AssetIDs,
+		Scripts:    req.Scripts,
+		Addresses:  req.Addresses,
+		MinAmount:  req.MinAmount,
+	}
+	utxos, err := asset.ListUTXOs(ctx, nil, filter)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"utxos": utxos}, nil
+}
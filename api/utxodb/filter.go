@@ -0,0 +1,30 @@
+package utxodb
+
+import "chain/fedchain/bc"
+
+// Filter narrows a utxo listing to only the outputs a caller cares
+// about. Within a single field, values are ORed together (e.g.
+// AccountIDs matches any one of the listed accounts); the fields
+// themselves are ANDed. A zero Filter matches everything.
+type Filter struct {
+	AccountIDs []string
+	AssetIDs   []string
+
+	// Scripts and Addresses both narrow by where an output pays to.
+	// Scripts holds raw control-program bytes; Addresses holds their
+	// already-encoded string form. A caller that only knows scripts
+	// (e.g. an SPV client) can use Scripts directly.
+	Scripts   [][]byte
+	Addresses []string
+
+	Outpoints []bc.Outpoint
+
+	// MinAmount excludes outputs smaller than this, in the output's
+	// own asset units. Zero means no minimum.
+	MinAmount uint64
+
+	// SpendableOnly excludes outputs that are currently reserved,
+	// per the Keeper. It has no effect if the caller doesn't also
+	// check reservations (see asset.ListUTXOs).
+	SpendableOnly bool
+}
@@ -0,0 +1,151 @@
+package utxodb
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// idempotencyCacheSize bounds the recently-completed LRU so that a
+// long-running server doesn't accumulate an unbounded number of
+// client tokens.
+const idempotencyCacheSize = 8192
+
+// reservation is the terminal result of a Reserve call, cached so that
+// a retry carrying the same client token gets back the exact same
+// answer instead of reserving new outputs.
+type reservation struct {
+	resID uint64
+	utxos []*UTXO
+	err   error
+}
+
+// call represents a reservation in flight. Callers racing on the same
+// key block on done and then share its result, singleflight-style.
+type call struct {
+	done chan struct{}
+	res  reservation
+}
+
+// idempotencyGroup de-duplicates concurrent and retried Reserve calls
+// that share the same (accountID, clientToken) key: the first caller
+// does the work, and every other caller — whether racing concurrently
+// or arriving later as a network retry — gets back its result.
+type idempotencyGroup struct {
+	mu       sync.Mutex
+	inflight map[string]*call
+	doneKeys map[string]*list.Element // key -> LRU element
+	lru      *list.List               // of *doneEntry, most-recent at front
+}
+
+type doneEntry struct {
+	key     string
+	res     reservation
+	expires time.Time
+}
+
+func newIdempotencyGroup() *idempotencyGroup {
+	return &idempotencyGroup{
+		inflight: make(map[string]*call),
+		doneKeys: make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func idempotencyKey(accountID, clientToken string) string {
+	return accountID + "\x00" + clientToken
+}
+
+// do runs fn at most once per key among concurrent and recent callers.
+// If a call for key is in flight, the caller blocks for its result. If
+// a call for key completed and the expiry recorded for it has not yet
+// passed, its cached result is returned immediately without running
+// fn again. expiresAt ties the cache entry's lifetime to the
+// reservation's own expiry — the same one passed to Reserve — rather
+// than to some independent TTL, so a replay can never outlive the
+// keeper's own bookkeeping: once the keeper's sweep would have
+// reclaimed the outputs, do stops serving the stale answer and lets
+// the caller reserve fresh ones instead.
+func (g *idempotencyGroup) do(key string, expiresAt time.Time, fn func() reservation) reservation {
+	g.mu.Lock()
+	if el, ok := g.doneKeys[key]; ok {
+		entry := el.Value.(*doneEntry)
+		if time.Now().Before(entry.expires) {
+			g.lru.MoveToFront(el)
+			g.mu.Unlock()
+			return entry.res
+		}
+		g.removeDone(key, el)
+	}
+	if c, ok := g.inflight[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.res
+	}
+	c := &call{done: make(chan struct{})}
+	g.inflight[key] = c
+	g.mu.Unlock()
+
+	c.res = fn()
+	close(c.done)
+
+	g.mu.Lock()
+	delete(g.inflight, key)
+	g.recordDone(key, c.res, expiresAt)
+	g.mu.Unlock()
+
+	return c.res
+}
+
+// recordDone must be called with g.mu held.
+func (g *idempotencyGroup) recordDone(key string, res reservation, expires time.Time) {
+	el := g.lru.PushFront(&doneEntry{
+		key:     key,
+		res:     res,
+		expires: expires,
+	})
+	g.doneKeys[key] = el
+	for g.lru.Len() > idempotencyCacheSize {
+		oldest := g.lru.Back()
+		g.removeDone(oldest.Value.(*doneEntry).key, oldest)
+	}
+}
+
+// removeDone must be called with g.mu held.
+func (g *idempotencyGroup) removeDone(key string, el *list.Element) {
+	g.lru.Remove(el)
+	delete(g.doneKeys, key)
+}
+
+// ReserveIdempotent is like Reserve, but callers may pass a
+// clientToken (matching the spendAction.ClientToken field on build
+// requests). Two calls with the same (accountID, clientToken) made
+// before expiresAt return the identical reservation — same utxo set,
+// same reservation ID — rather than reserving new outputs, so retries
+// over a flaky network are safe. Once expiresAt passes, the cached
+// answer is no longer good: the keeper's own sweep would have already
+// returned those outputs to circulation, so a later retry with the
+// same token reserves fresh ones instead of being told it still holds
+// outputs it doesn't. An empty clientToken disables de-duplication and
+// behaves exactly like Reserve.
+func (k *Keeper) ReserveIdempotent(accountID, assetID string, amount uint64, clientToken string, expiresAt time.Time) (resID uint64, utxos []*UTXO, err error) {
+	if clientToken == "" {
+		return k.Reserve(accountID, assetID, amount, expiresAt)
+	}
+
+	key := idempotencyKey(accountID, clientToken)
+	res := k.idempotency().do(key, expiresAt, func() reservation {
+		resID, utxos, err := k.Reserve(accountID, assetID, amount, expiresAt)
+		return reservation{resID: resID, utxos: utxos, err: err}
+	})
+	return res.resID, res.utxos, res.err
+}
+
+func (k *Keeper) idempotency() *idempotencyGroup {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.idemGroup == nil {
+		k.idemGroup = newIdempotencyGroup()
+	}
+	return k.idemGroup
+}
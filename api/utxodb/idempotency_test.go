@@ -0,0 +1,81 @@
+package utxodb
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"chain/fedchain/bc"
+)
+
+func TestReserveIdempotentDeduplicates(t *testing.T) {
+	k := NewKeeper()
+	for i := 0; i < 5; i++ {
+		k.Add(&UTXO{
+			AccountID: "acc1",
+			AssetID:   "asset1",
+			Amount:    1,
+			Outpoint:  bc.Outpoint{Index: uint32(i)},
+		}, false)
+	}
+
+	const callers = 10
+	var wg sync.WaitGroup
+	resIDs := make([]uint64, callers)
+	errs := make([]error, callers)
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resIDs[i], _, errs[i] = k.ReserveIdempotent("acc1", "asset1", 1, "tok1", time.Now().Add(time.Minute))
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+	for i := 1; i < callers; i++ {
+		if resIDs[i] != resIDs[0] {
+			t.Errorf("call %d got reservation %d, want %d (same as call 0)", i, resIDs[i], resIDs[0])
+		}
+	}
+
+	// A distinct client token must still get its own reservation.
+	resID2, _, err := k.ReserveIdempotent("acc1", "asset1", 1, "tok2", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resID2 == resIDs[0] {
+		t.Errorf("distinct client token reused reservation %d", resID2)
+	}
+}
+
+func TestReserveIdempotentDoesNotReplayAfterExpiry(t *testing.T) {
+	k := NewKeeper()
+	k.Add(&UTXO{AccountID: "acc1", AssetID: "asset1", Amount: 5, Outpoint: bc.Outpoint{Index: 0}}, false)
+
+	_, utxos, err := k.ReserveIdempotent("acc1", "asset1", 5, "tok1", time.Now().Add(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 1 {
+		t.Fatalf("got %d utxos, want 1", len(utxos))
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// By now the keeper's own sweep would have reclaimed this
+	// reservation (it hasn't here only because the test doesn't run
+	// ExpireReservations), so a retry with the same token must not
+	// blindly replay the first call's success. It should attempt a
+	// fresh reservation, which fails exactly as any other caller's
+	// would while the output is still actually held under the expired
+	// reservation.
+	if _, _, err := k.ReserveIdempotent("acc1", "asset1", 5, "tok1", time.Now().Add(time.Minute)); err == nil {
+		t.Fatal("expected retry after cache expiry to attempt a fresh reservation and fail, not replay the stale success")
+	}
+}
@@ -0,0 +1,271 @@
+package utxodb
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"chain/errors"
+	"chain/fedchain/bc"
+)
+
+// ErrInsufficientFunds is returned by Keeper.Reserve when an
+// (account, asset) pair does not have enough available outputs to
+// cover the requested amount.
+var ErrInsufficientFunds = errors.New("reservation found insufficient funds")
+
+// reservationExpiry is how often ExpireReservations sweeps for
+// reservations past their expiry. How long a reservation is held is
+// set by the expiresAt passed to Reserve.
+const reservationExpiry = time.Minute
+
+// Keeper tracks the spendable utxo set in memory, sharded by
+// (accountID, assetID), so that concurrent transaction builders can
+// reserve outputs without touching the database. It replaces the
+// utxos.reserved_until column: the SQL layer keeps only the
+// authoritative output set, and Keeper is populated from it at
+// startup. Keeper does not watch the store: outputs attached or
+// applied after that reach it only through Add and Remove.
+type Keeper struct {
+	mu        sync.Mutex
+	shards    map[shardKey]*shard
+	nextRes   uint64
+	idemGroup *idempotencyGroup
+}
+
+type shardKey struct {
+	accountID string
+	assetID   string
+}
+
+// shard holds the utxo set for a single (accountID, assetID) pair.
+// Every output in the shard is in exactly one of the three maps.
+type shard struct {
+	mu          sync.Mutex
+	unconfirmed map[bc.Outpoint]*UTXO
+	available   map[bc.Outpoint]*UTXO
+	reserved    map[bc.Outpoint]*reservedUTXO
+}
+
+type reservedUTXO struct {
+	utxo        *UTXO
+	resID       uint64
+	expires     time.Time
+	unconfirmed bool // which map to return utxo to on cancel/expiry
+}
+
+// NewKeeper returns an empty Keeper. Callers should hydrate it with
+// asset.WarmUpKeeper before serving reservations, and should
+// start the expirer with Keeper.ExpireReservations in a goroutine.
+func NewKeeper() *Keeper {
+	return &Keeper{shards: make(map[shardKey]*shard)}
+}
+
+func (k *Keeper) shardFor(accountID, assetID string) *shard {
+	key := shardKey{accountID, assetID}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, ok := k.shards[key]
+	if !ok {
+		s = &shard{
+			unconfirmed: make(map[bc.Outpoint]*UTXO),
+			available:   make(map[bc.Outpoint]*UTXO),
+			reserved:    make(map[bc.Outpoint]*reservedUTXO),
+		}
+		k.shards[key] = s
+	}
+	return s
+}
+
+func (k *Keeper) nextReservationID() uint64 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.nextRes++
+	return k.nextRes
+}
+
+// Add makes utxo available for reservation. It is used both to warm
+// up the keeper from the confirmed utxo set and to record outputs of
+// unconfirmed, pool-only transactions.
+func (k *Keeper) Add(utxo *UTXO, unconfirmed bool) {
+	s := k.shardFor(utxo.AccountID, utxo.AssetID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if unconfirmed {
+		s.unconfirmed[utxo.Outpoint] = utxo
+	} else {
+		s.available[utxo.Outpoint] = utxo
+	}
+}
+
+// Remove takes utxo out of the keeper entirely, whichever of the three
+// maps it's currently in. It's used when an output is spent by a
+// confirmed transaction or its creating transaction is detached from
+// the pool.
+func (k *Keeper) Remove(accountID, assetID string, out bc.Outpoint) {
+	s := k.shardFor(accountID, assetID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.unconfirmed, out)
+	delete(s.available, out)
+	delete(s.reserved, out)
+}
+
+// IsReserved reports whether out, an output of accountID/assetID, is
+// currently held by an outstanding reservation. It's used by
+// ListUTXOs's SpendableOnly filter; an output not known to the keeper
+// at all (e.g. it was never hydrated) is reported as not reserved.
+func (k *Keeper) IsReserved(accountID, assetID string, out bc.Outpoint) bool {
+	s := k.shardFor(accountID, assetID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.reserved[out]
+	return ok
+}
+
+// candidate pairs a utxo with the shard map it was drawn from, so
+// Reserve can put it back in the right place on cancel or expiry.
+type candidate struct {
+	utxo        *UTXO
+	unconfirmed bool
+}
+
+// outpointLess orders outpoints so that Reserve's selection doesn't
+// depend on Go's randomized map iteration order.
+func outpointLess(a, b bc.Outpoint) bool {
+	ah, bh := a.Hash.String(), b.Hash.String()
+	if ah != bh {
+		return ah < bh
+	}
+	return a.Index < b.Index
+}
+
+// Reserve deterministically selects outputs of asset assetID owned by
+// accountID covering amount, moves them from available (and, per
+// chunk0-1, unconfirmed) to reserved with the given expiry, and
+// returns a reservation ID along with the selected outputs.
+// Unconfirmed outputs — those from a transaction still in the pool,
+// added via Add(utxo, true) — are just as reservable as confirmed
+// ones, which is what makes chain-spending possible: a later tx in
+// the same pool can spend an output its predecessor only just
+// created. Reserve is safe to call concurrently: two callers racing
+// for the same shard cannot both reserve the same output, because
+// selection and the map moves happen under the shard's single mutex.
+func (k *Keeper) Reserve(accountID, assetID string, amount uint64, expiresAt time.Time) (resID uint64, utxos []*UTXO, err error) {
+	s := k.shardFor(accountID, assetID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cands := make([]candidate, 0, len(s.available)+len(s.unconfirmed))
+	for _, u := range s.available {
+		cands = append(cands, candidate{utxo: u})
+	}
+	for _, u := range s.unconfirmed {
+		cands = append(cands, candidate{utxo: u, unconfirmed: true})
+	}
+	sort.Slice(cands, func(i, j int) bool {
+		return outpointLess(cands[i].utxo.Outpoint, cands[j].utxo.Outpoint)
+	})
+
+	var sum uint64
+	var picked []candidate
+	for _, c := range cands {
+		picked = append(picked, c)
+		sum += c.utxo.Amount
+		if sum >= amount {
+			break
+		}
+	}
+	if sum < amount {
+		return 0, nil, errors.Wrap(ErrInsufficientFunds)
+	}
+
+	resID = k.nextReservationID()
+	utxos = make([]*UTXO, 0, len(picked))
+	for _, c := range picked {
+		if c.unconfirmed {
+			delete(s.unconfirmed, c.utxo.Outpoint)
+		} else {
+			delete(s.available, c.utxo.Outpoint)
+		}
+		s.reserved[c.utxo.Outpoint] = &reservedUTXO{
+			utxo:        c.utxo,
+			resID:       resID,
+			expires:     expiresAt,
+			unconfirmed: c.unconfirmed,
+		}
+		utxos = append(utxos, c.utxo)
+	}
+	return resID, utxos, nil
+}
+
+// putBack returns a reserved output to whichever map it came from.
+// Must be called with s.mu held.
+func (s *shard) putBack(out bc.Outpoint, r *reservedUTXO) {
+	if r.unconfirmed {
+		s.unconfirmed[out] = r.utxo
+	} else {
+		s.available[out] = r.utxo
+	}
+	delete(s.reserved, out)
+}
+
+// Cancel returns every output reserved under resID to whichever of
+// available or unconfirmed it was drawn from. It is idempotent:
+// cancelling an unknown or already-cancelled reservation ID is a
+// no-op.
+func (k *Keeper) Cancel(resID uint64) {
+	k.mu.Lock()
+	shards := make([]*shard, 0, len(k.shards))
+	for _, s := range k.shards {
+		shards = append(shards, s)
+	}
+	k.mu.Unlock()
+
+	for _, s := range shards {
+		s.mu.Lock()
+		for out, r := range s.reserved {
+			if r.resID == resID {
+				s.putBack(out, r)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// ExpireReservations runs until stop is closed, periodically sweeping
+// every shard for reservations past their expiry and returning their
+// outputs to whichever of available or unconfirmed they were drawn
+// from. Callers start it in a goroutine
+// alongside the keeper.
+func (k *Keeper) ExpireReservations(stop <-chan struct{}) {
+	ticker := time.NewTicker(reservationExpiry)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			k.sweep(now)
+		}
+	}
+}
+
+func (k *Keeper) sweep(now time.Time) {
+	k.mu.Lock()
+	shards := make([]*shard, 0, len(k.shards))
+	for _, s := range k.shards {
+		shards = append(shards, s)
+	}
+	k.mu.Unlock()
+
+	for _, s := range shards {
+		s.mu.Lock()
+		for out, r := range s.reserved {
+			if now.After(r.expires) {
+				s.putBack(out, r)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,104 @@
+package utxodb
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"chain/fedchain/bc"
+)
+
+func TestKeeperReserveNoDoubleSpend(t *testing.T) {
+	k := NewKeeper()
+	for i := 0; i < 10; i++ {
+		k.Add(&UTXO{
+			AccountID: "acc1",
+			AssetID:   "asset1",
+			Amount:    1,
+			Outpoint:  bc.Outpoint{Index: uint32(i)},
+		}, false)
+	}
+
+	const builders = 20
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	seen := make(map[bc.Outpoint]bool)
+
+	for i := 0; i < builders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, utxos, err := k.Reserve("acc1", "asset1", 1, time.Now().Add(time.Minute))
+			if err != nil {
+				// Expected once the 10 outputs are exhausted.
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, u := range utxos {
+				if seen[u.Outpoint] {
+					t.Errorf("outpoint %v reserved twice", u.Outpoint)
+				}
+				seen[u.Outpoint] = true
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) > 10 {
+		t.Errorf("got %d reserved outpoints, want at most 10", len(seen))
+	}
+}
+
+func TestKeeperReserveUnconfirmed(t *testing.T) {
+	k := NewKeeper()
+	out := bc.Outpoint{Index: 0}
+	k.Add(&UTXO{AccountID: "acc1", AssetID: "asset1", Amount: 5, Outpoint: out}, true)
+
+	resID, utxos, err := k.Reserve("acc1", "asset1", 5, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("expected unconfirmed output to be reservable: %v", err)
+	}
+	if len(utxos) != 1 || utxos[0].Outpoint != out {
+		t.Fatalf("got %v, want [%v]", utxos, out)
+	}
+
+	// It's genuinely gone from the pool until cancelled; a second
+	// caller can't also reserve it.
+	if _, _, err := k.Reserve("acc1", "asset1", 5, time.Now().Add(time.Minute)); err == nil {
+		t.Fatal("expected second reservation of the same unconfirmed output to fail")
+	}
+
+	// Cancelling returns it to the unconfirmed pool, not available,
+	// so IsReserved reports false again but it's still reservable.
+	k.Cancel(resID)
+	if k.IsReserved("acc1", "asset1", out) {
+		t.Fatal("expected output to no longer be reserved after cancel")
+	}
+	if _, _, err := k.Reserve("acc1", "asset1", 5, time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("expected unconfirmed output to be reservable again after cancel: %v", err)
+	}
+}
+
+func TestKeeperCancelReturnsOutputs(t *testing.T) {
+	k := NewKeeper()
+	k.Add(&UTXO{AccountID: "acc1", AssetID: "asset1", Amount: 5, Outpoint: bc.Outpoint{Index: 0}}, false)
+
+	resID, utxos, err := k.Reserve("acc1", "asset1", 5, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 1 {
+		t.Fatalf("got %d utxos, want 1", len(utxos))
+	}
+
+	if _, _, err := k.Reserve("acc1", "asset1", 5, time.Now().Add(time.Minute)); err == nil {
+		t.Fatal("expected second reservation to fail while first is outstanding")
+	}
+
+	k.Cancel(resID)
+
+	if _, _, err := k.Reserve("acc1", "asset1", 5, time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("expected reservation to succeed after cancel: %v", err)
+	}
+}